@@ -10,10 +10,21 @@
 package main
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"net/url"
+	"os"
+	"strconv"
 	"strings"
 	"time"
 
@@ -21,6 +32,100 @@ import (
 	"github.com/tinode/chat/server/store/types"
 )
 
+// archiveTotalSizeCap is the maximum sum of individual file sizes largeFileServeArchive will
+// stream back in a single response.
+const archiveTotalSizeCap = 1 << 30 // 1 GiB
+
+// errContentRejected is returned by commitUploadContent when the configured MediaScanner
+// flagged the content as infected.
+var errContentRejected = errors.New("media: content rejected")
+
+// commitUploadContent is the single path every upload transport (plain POST, tus) routes its
+// fully-received bytes through: it hashes content, short-circuits via the content-addressable
+// store if a matching blob is already stored, otherwise scans it with the configured
+// MediaScanner and hands it to mh.Upload. Keeping this in one place means no transport can land
+// a file without going through dedup and the malware scan.
+//
+// The caller must have already reserved fdef with store.Files.StartUpload before calling this
+// (tusCreateUpload does so at creation time; largeFileUpload does it just before calling in).
+// commitUploadContent owns every terminal state of that reservation from there: it completes it
+// as the new committed row on success, or as UploadFailed (discarding it) on a dedup hit, a
+// scanner rejection or an upload error, so callers never need their own follow-up
+// store.Files.CompleteUpload call.
+func commitUploadContent(mh store.MediaHandler, fdef *types.FileDef, content *os.File) (url, digest string, err error) {
+	fail := func(verdict types.ScanVerdict) {
+		store.Files.CompleteUpload(fdef.Id, types.UploadFailed, "", "", 0, verdict)
+	}
+
+	if _, err = content.Seek(0, io.SeekStart); err != nil {
+		fail(types.ScanNotScanned)
+		return "", "", err
+	}
+
+	hasher := sha256.New()
+	size, err := io.Copy(hasher, content)
+	if err != nil {
+		fail(types.ScanNotScanned)
+		return "", "", err
+	}
+	digest = hex.EncodeToString(hasher.Sum(nil))
+	fdef.Size = size
+	fdef.ETag = digest
+
+	if existing, ferr := store.Files.FindByDigest(digest); ferr == nil && existing != nil {
+		// Link the uploader onto the existing blob instead of storing a duplicate, and
+		// discard this upload's own reservation: it was only needed in case the content
+		// turned out to be new.
+		if lerr := store.Files.LinkFile(existing.Id, fdef.User); lerr != nil {
+			log.Println("media upload: link existing:", lerr)
+		}
+		fail(types.ScanNotScanned)
+		return existing.Location, digest, nil
+	}
+
+	if _, err = content.Seek(0, io.SeekStart); err != nil {
+		fail(types.ScanNotScanned)
+		return "", "", err
+	}
+
+	verdict := types.ScanNotScanned
+	if scanner := globals.mediaScanner; scanner != nil {
+		sverdict, serr := scanner.Scan(content, fdef.MimeType)
+		if serr != nil {
+			if globals.mediaScanFailClosed {
+				fail(types.ScanNotScanned)
+				return "", "", serr
+			}
+			// fail_open: log and proceed as if the content were clean.
+			log.Println("media upload: scanner error, failing open:", serr)
+		} else {
+			verdict = sverdict
+			if verdict == types.ScanInfected {
+				fail(verdict)
+				return "", "", errContentRejected
+			}
+		}
+		if _, err = content.Seek(0, io.SeekStart); err != nil {
+			fail(types.ScanNotScanned)
+			return "", "", err
+		}
+	}
+
+	url, err = mh.Upload(fdef, content)
+	if err != nil {
+		fail(types.ScanNotScanned)
+		return "", "", err
+	}
+	fdef.ScanVerdict = verdict
+
+	// mh.Upload fills in fdef.Location (the real backend path/key); that's what StatObject and
+	// a later Download need, as opposed to url, the public-facing download link.
+	if err = store.Files.CompleteUpload(fdef.Id, types.UploadCompleted, fdef.Location, digest, size, verdict); err != nil {
+		return "", "", err
+	}
+	return url, digest, nil
+}
+
 func largeFileServe(wrt http.ResponseWriter, req *http.Request) {
 	now := time.Now().UTC().Round(time.Millisecond)
 	enc := json.NewEncoder(wrt)
@@ -75,13 +180,202 @@ func largeFileServe(wrt http.ResponseWriter, req *http.Request) {
 
 	defer rsc.Close()
 
+	if fd.ScanVerdict == types.ScanInfected {
+		// A signature update flagged this file after it was accepted: block re-downloads
+		// retroactively instead of waiting for the next GC sweep to remove it.
+		writeHttpResponse(ErrContentRejected("", "", now), nil)
+		return
+	}
+
+	disposition := "attachment"
+	if req.URL.Query().Get("inline") == "1" || strings.EqualFold(req.URL.Query().Get("disposition"), "inline") {
+		disposition = "inline"
+	}
+
 	wrt.Header().Set("Content-Type", fd.MimeType)
-	wrt.Header().Set("Content-Disposition", "attachment")
-	http.ServeContent(wrt, req, "", fd.UpdatedAt, rsc)
+	wrt.Header().Set("Content-Disposition", contentDisposition(disposition, archiveEntryName(fd)))
+	if fd.ETag != "" {
+		// The digest uniquely identifies the content: a strong ETag lets browsers cache
+		// aggressively and do conditional/range requests without re-fetching the whole file.
+		wrt.Header().Set("ETag", `"`+fd.ETag+`"`)
+	}
+
+	// rsc is a ReadSeekCloser regardless of backend (local disk, S3, GCS): http.ServeContent
+	// uses the Seek offsets to translate a client Range header into the byte range the media
+	// handler reads from its backend, so Range requests work end-to-end without buffering.
+	http.ServeContent(wrt, req, archiveEntryName(fd), fd.UpdatedAt, rsc)
 
 	log.Println("media served OK")
 }
 
+// contentDisposition builds a Content-Disposition header value with both a best-effort ASCII
+// filename and an RFC 5987 percent-encoded filename* for clients that support Unicode names.
+func contentDisposition(disposition, filename string) string {
+	ascii := make([]rune, 0, len(filename))
+	for _, r := range filename {
+		if r < 0x20 || r == '"' || r > 0x7e {
+			continue
+		}
+		ascii = append(ascii, r)
+	}
+	return fmt.Sprintf(`%s; filename="%s"; filename*=UTF-8''%s`, disposition, string(ascii), url.PathEscape(filename))
+}
+
+// largeFileServeArchive streams a set of the caller's own attachments back as a single
+// .zip or .tar.gz, selected by the "format" query parameter or, failing that, the Accept
+// header. Files the caller isn't entitled to read get an error entry in the archive instead
+// of aborting the whole stream.
+func largeFileServeArchive(wrt http.ResponseWriter, req *http.Request) {
+	now := time.Now().UTC().Round(time.Millisecond)
+	enc := json.NewEncoder(wrt)
+
+	writeHttpResponse := func(msg *ServerComMessage, err error) {
+		wrt.Header().Set("Content-Type", "application/json; charset=utf-8")
+		wrt.WriteHeader(msg.Ctrl.Code)
+		enc.Encode(msg)
+
+		log.Println("media serve archive", msg.Ctrl.Code, msg.Ctrl.Text, err)
+	}
+
+	// Check for API key presence
+	if isValid, _ := checkAPIKey(getAPIKey(req)); !isValid {
+		writeHttpResponse(ErrAPIKeyRequired(now), nil)
+		return
+	}
+
+	// Check authorization: either auth information or SID must be present
+	uid, challenge, err := authHttpRequest(req)
+	if err != nil {
+		writeHttpResponse(decodeStoreError(err, "", "", now, nil), err)
+		return
+	}
+	if challenge != nil {
+		writeHttpResponse(InfoChallenge("", now, challenge), nil)
+		return
+	}
+	if uid.IsZero() {
+		writeHttpResponse(ErrAuthRequired("", "", now), nil)
+		return
+	}
+
+	fids, err := archiveRequestedFids(req)
+	if err != nil {
+		writeHttpResponse(ErrMalformed("", "", now), err)
+		return
+	}
+	if len(fids) == 0 {
+		writeHttpResponse(ErrMalformed("", "", now), nil)
+		return
+	}
+
+	asTarGz := req.URL.Query().Get("format") == "tar.gz" ||
+		(req.URL.Query().Get("format") == "" && strings.Contains(req.Header.Get("Accept"), "gzip"))
+
+	mh := store.GetMediaHandler()
+	if asTarGz {
+		wrt.Header().Set("Content-Type", "application/gzip")
+		wrt.Header().Set("Content-Disposition", "attachment; filename=\"attachments.tar.gz\"")
+		wrt.WriteHeader(http.StatusOK)
+
+		gzw := gzip.NewWriter(wrt)
+		defer gzw.Close()
+		tw := tar.NewWriter(gzw)
+		defer tw.Close()
+
+		streamArchiveEntries(fids, uid, mh, func(name string, mime string, size int64, content io.Reader) error {
+			if err := tw.WriteHeader(&tar.Header{Name: name, Size: size, Mode: 0644}); err != nil {
+				return err
+			}
+			_, err := io.Copy(tw, content)
+			return err
+		})
+		return
+	}
+
+	wrt.Header().Set("Content-Type", "application/zip")
+	wrt.Header().Set("Content-Disposition", "attachment; filename=\"attachments.zip\"")
+	wrt.WriteHeader(http.StatusOK)
+
+	zw := zip.NewWriter(wrt)
+	defer zw.Close()
+
+	streamArchiveEntries(fids, uid, mh, func(name string, mime string, size int64, content io.Reader) error {
+		entry, err := zw.Create(name)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(entry, content)
+		return err
+	})
+}
+
+// streamArchiveEntries resolves each requested file id in turn, enforcing ownership and a
+// total-size cap, and calls writeEntry for each one that is readable. Files that fail the ACL
+// check or push the total over the cap get a small ".error.txt" entry instead of aborting the
+// whole archive.
+func streamArchiveEntries(fids []string, uid types.Uid, mh store.MediaHandler, writeEntry func(name, mime string, size int64, content io.Reader) error) {
+	writeError := func(fid, msg string) {
+		writeEntry(fid+".error.txt", "text/plain", int64(len(msg)), strings.NewReader(msg))
+	}
+
+	var total int64
+	for _, fid := range fids {
+		fdef, rsc, err := mh.Download(fid)
+		if err != nil {
+			writeError(fid, err.Error())
+			continue
+		}
+
+		if !fdef.CanRead(uid.String()) {
+			rsc.Close()
+			writeError(fid, "permission denied")
+			continue
+		}
+
+		if total+fdef.Size > archiveTotalSizeCap {
+			rsc.Close()
+			writeError(fid, "archive size cap exceeded")
+			continue
+		}
+		total += fdef.Size
+
+		if err := writeEntry(archiveEntryName(fdef), fdef.MimeType, fdef.Size, rsc); err != nil {
+			rsc.Close()
+			log.Println("media serve archive: entry write failed:", fid, err)
+			continue
+		}
+		rsc.Close()
+	}
+}
+
+// archiveEntryName picks a per-entry file name for the archive. Falls back to the file id
+// when no better name is available in the FileDef.
+func archiveEntryName(fdef *types.FileDef) string {
+	if fdef.Location != "" {
+		if idx := strings.LastIndex(fdef.Location, "/"); idx >= 0 {
+			return fdef.Location[idx+1:]
+		}
+		return fdef.Location
+	}
+	return fdef.Id
+}
+
+// archiveRequestedFids reads the list of requested file ids from the query string
+// (?fid=a&fid=b) or, for a POST, from a JSON body: {"fids": ["a", "b"]}.
+func archiveRequestedFids(req *http.Request) ([]string, error) {
+	if req.Method == http.MethodPost {
+		var body struct {
+			Fids []string `json:"fids"`
+		}
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			return nil, err
+		}
+		return body.Fids, nil
+	}
+
+	return req.URL.Query()["fid"], nil
+}
+
 // largeFileUpload receives files from client over HTTP(S) and saves them to local file
 // system.
 func largeFileUpload(wrt http.ResponseWriter, req *http.Request) {
@@ -169,14 +463,42 @@ func largeFileUpload(wrt http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	url, err := mh.Upload(&fdef, file)
+	// Spool the body to a temp file: commitUploadContent needs to seek it multiple times
+	// (hash, dedup lookup, scan, upload) and req.FormFile's own file may not support that.
+	tmp, err := os.CreateTemp("", "tinode-upload-")
+	if err != nil {
+		writeHttpResponse(ErrUnknown(msgID, "", now), err)
+		return
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if _, err = io.Copy(tmp, file); err != nil {
+		writeHttpResponse(ErrUnknown(msgID, "", now), err)
+		return
+	}
+
+	// Reserve fdef in store.Files before handing it to commitUploadContent, the same way
+	// tusCreateUpload reserves one up front: it's what lets a new (non-deduplicated) upload end
+	// up registered for future dedup lookups, ACL checks and rescans instead of only existing
+	// as whatever mh.Upload did with the bytes.
+	if err = store.Files.StartUpload(&fdef); err != nil {
+		writeHttpResponse(ErrUnknown(msgID, "", now), err)
+		return
+	}
+
+	url, digest, err := commitUploadContent(mh, &fdef, tmp)
+	if err == errContentRejected {
+		writeHttpResponse(ErrContentRejected(msgID, "", now), nil)
+		return
+	}
 	if err != nil {
 		writeHttpResponse(decodeStoreError(err, msgID, "", now, nil), err)
 		return
 	}
 
 	resp := NoErr(msgID, "", now)
-	resp.Ctrl.Params = map[string]string{"url": url}
+	resp.Ctrl.Params = map[string]string{"url": url, "digest": digest}
 	writeHttpResponse(resp, nil)
 }
 
@@ -184,12 +506,29 @@ func largeFileRunGarbageCollection(period time.Duration, block int) chan<- bool
 	stop := make(chan bool)
 	go func() {
 		gcTimer := time.Tick(period)
+		// Quarantined (scanner-flagged) files are swept on their own schedule: their
+		// store.Files rows and spooled bytes are removed, which makes them undownloadable.
+		// The copy the MediaHandler stored at fdef.Location is not deleted here.
+		quarantineTimer := time.Tick(quarantineSweepPeriod)
 		for {
 			select {
 			case <-gcTimer:
 				if err := store.Files.DeleteUnused(time.Now().Add(-time.Hour), block); err != nil {
 					log.Println("media gc:", err)
 				}
+				if err := store.Files.DeleteStaleUploads(time.Now().Add(-tusUploadExpiration)); err != nil {
+					log.Println("media gc (tus):", err)
+				}
+			case <-quarantineTimer:
+				// Pick up files flagged by a scanner signature update since they were first
+				// accepted, not just ones that were already infected at upload time.
+				rescanStoredFiles(store.GetMediaHandler())
+				if err := store.Files.DeleteQuarantined(block); err != nil {
+					log.Println("media gc (quarantine):", err)
+				}
+				if err := store.Files.DeleteStaleUploads(time.Now().Add(-presignPendingExpiration)); err != nil {
+					log.Println("media gc (presign pending):", err)
+				}
 			case <-stop:
 				return
 			}
@@ -198,3 +537,459 @@ func largeFileRunGarbageCollection(period time.Duration, block int) chan<- bool
 
 	return stop
 }
+
+// quarantineSweepPeriod is how often largeFileRunGarbageCollection purges blobs that
+// MediaScanner has flagged as infected.
+const quarantineSweepPeriod = 10 * time.Minute
+
+// tusResumableVersion is the tus.io protocol version this server implements.
+const tusResumableVersion = "1.0.0"
+
+// tusUploadExpiration is how long an incomplete resumable upload is kept around before
+// largeFileRunGarbageCollection reclaims it.
+const tusUploadExpiration = 24 * time.Hour
+
+// largeFileUploadTus handles the tus.io resumable upload protocol: POST creates an upload
+// and returns its Location, HEAD reports the current offset, PATCH appends a chunk. This lets
+// mobile clients resume an interrupted large-attachment upload instead of restarting it.
+func largeFileUploadTus(wrt http.ResponseWriter, req *http.Request) {
+	now := time.Now().UTC().Round(time.Millisecond)
+	enc := json.NewEncoder(wrt)
+	mh := store.GetMediaHandler()
+
+	writeHttpResponse := func(msg *ServerComMessage, err error) {
+		wrt.Header().Set("Content-Type", "application/json; charset=utf-8")
+		wrt.Header().Set("Tus-Resumable", tusResumableVersion)
+		wrt.WriteHeader(msg.Ctrl.Code)
+		enc.Encode(msg)
+
+		log.Println("media tus", req.Method, msg.Ctrl.Code, msg.Ctrl.Text, err)
+	}
+
+	// Every tus request must declare the protocol version it speaks; reject anything else
+	// instead of silently assuming compatibility.
+	if req.Header.Get("Tus-Resumable") != tusResumableVersion {
+		writeHttpResponse(ErrMalformed("", "", now), nil)
+		return
+	}
+
+	// Check for API key presence
+	if isValid, _ := checkAPIKey(getAPIKey(req)); !isValid {
+		writeHttpResponse(ErrAPIKeyRequired(now), nil)
+		return
+	}
+
+	// Check authorization: either auth information or SID must be present
+	uid, challenge, err := authHttpRequest(req)
+	if err != nil {
+		writeHttpResponse(decodeStoreError(err, "", "", now, nil), err)
+		return
+	}
+	if challenge != nil {
+		writeHttpResponse(InfoChallenge("", now, challenge), nil)
+		return
+	}
+	if uid.IsZero() {
+		writeHttpResponse(ErrAuthRequired("", "", now), nil)
+		return
+	}
+
+	switch req.Method {
+	case http.MethodPost:
+		tusCreateUpload(wrt, req, uid, now, writeHttpResponse)
+	case http.MethodHead:
+		tusGetOffset(wrt, req, uid, now, writeHttpResponse)
+	case http.MethodPatch:
+		tusAppendChunk(wrt, req, uid, now, writeHttpResponse, mh)
+	default:
+		writeHttpResponse(ErrOperationNotAllowed("", "", now), nil)
+	}
+}
+
+// tusCreateUpload handles the tus "create" request: it reserves a FileDef with the declared
+// total size and returns its Location for subsequent PATCH requests.
+func tusCreateUpload(wrt http.ResponseWriter, req *http.Request, uid types.Uid, now time.Time,
+	writeHttpResponse func(*ServerComMessage, error)) {
+
+	uploadLength, err := strconv.ParseInt(req.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || uploadLength < 0 {
+		writeHttpResponse(ErrMalformed("", "", now), err)
+		return
+	}
+
+	// The declared total size is checked against the cap, not each individual PATCH body.
+	if globals.maxFileUploadSize > 0 && uploadLength > globals.maxFileUploadSize {
+		writeHttpResponse(ErrTooLarge("", "", now), nil)
+		return
+	}
+
+	fdef := types.FileDef{}
+	fdef.Id = store.GetUidString()
+	fdef.InitTimes()
+	fdef.User = uid.String()
+	fdef.Status = types.UploadStarted
+	fdef.Size = uploadLength
+	if meta := req.Header.Get("Upload-Metadata"); meta != "" {
+		fdef.MimeType = tusMetaValue(meta, "filetype")
+	}
+
+	if err := store.Files.StartUpload(&fdef); err != nil {
+		writeHttpResponse(decodeStoreError(err, "", "", now, nil), err)
+		return
+	}
+
+	wrt.Header().Set("Location", req.URL.String()+"/"+fdef.Id)
+	wrt.Header().Set("Upload-Offset", "0")
+	wrt.WriteHeader(http.StatusCreated)
+}
+
+// tusGetOffset handles the tus HEAD request: report how many bytes of the upload have
+// been received so far.
+func tusGetOffset(wrt http.ResponseWriter, req *http.Request, uid types.Uid, now time.Time,
+	writeHttpResponse func(*ServerComMessage, error)) {
+
+	fid := tusUploadIdFromPath(req.URL.Path)
+	fdef, offset, err := store.Files.GetUpload(fid)
+	if err != nil {
+		writeHttpResponse(decodeStoreError(err, "", "", now, nil), err)
+		return
+	}
+	if fdef.User != uid.String() {
+		writeHttpResponse(ErrPermissionDenied("", "", now), nil)
+		return
+	}
+
+	wrt.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	wrt.Header().Set("Upload-Length", strconv.FormatInt(fdef.Size, 10))
+	wrt.Header().Set("Cache-Control", "no-store")
+	wrt.WriteHeader(http.StatusOK)
+}
+
+// tusAppendChunk handles the tus PATCH request: append a chunk at the given offset and, once
+// the declared length has been received, hand the assembled blob to mh.Upload exactly as a
+// regular upload would.
+func tusAppendChunk(wrt http.ResponseWriter, req *http.Request, uid types.Uid, now time.Time,
+	writeHttpResponse func(*ServerComMessage, error), mh store.MediaHandler) {
+
+	if req.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		writeHttpResponse(ErrMalformed("", "", now), nil)
+		return
+	}
+
+	fid := tusUploadIdFromPath(req.URL.Path)
+	offset, err := strconv.ParseInt(req.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		writeHttpResponse(ErrMalformed("", "", now), err)
+		return
+	}
+
+	fdef, curOffset, err := store.Files.GetUpload(fid)
+	if err != nil {
+		writeHttpResponse(decodeStoreError(err, "", "", now, nil), err)
+		return
+	}
+	if fdef.User != uid.String() {
+		writeHttpResponse(ErrPermissionDenied("", "", now), nil)
+		return
+	}
+	if offset != curOffset {
+		// Client and server disagree on the current offset: 409 per the tus spec.
+		writeHttpResponse(decodeStoreError(types.ErrConflict, "", "", now, nil), nil)
+		return
+	}
+
+	newOffset, err := store.Files.AppendUpload(fid, req.Body, fdef.Size-curOffset)
+	if err != nil {
+		writeHttpResponse(decodeStoreError(err, "", "", now, nil), err)
+		return
+	}
+
+	wrt.Header().Set("Upload-Offset", strconv.FormatInt(newOffset, 10))
+
+	if newOffset < fdef.Size {
+		wrt.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	// Upload complete: route the assembled blob through the same dedup/scan path a regular
+	// upload goes through, so a resumable upload can't bypass either one.
+	blob, err := store.Files.ReadUpload(fid)
+	if err != nil {
+		writeHttpResponse(decodeStoreError(err, "", "", now, nil), err)
+		return
+	}
+	defer blob.Close()
+
+	url, _, err := commitUploadContent(mh, fdef, blob)
+	if err == errContentRejected {
+		writeHttpResponse(ErrContentRejected("", "", now), nil)
+		return
+	}
+	if err != nil {
+		writeHttpResponse(decodeStoreError(err, "", "", now, nil), err)
+		return
+	}
+
+	resp := NoErr("", "", now)
+	resp.Ctrl.Params = map[string]string{"url": url}
+	writeHttpResponse(resp, nil)
+}
+
+// tusUploadIdFromPath extracts the upload id, the last path segment, from a tus request URL.
+func tusUploadIdFromPath(path string) string {
+	path = strings.TrimSuffix(path, "/")
+	if idx := strings.LastIndex(path, "/"); idx >= 0 {
+		return path[idx+1:]
+	}
+	return path
+}
+
+// tusMetaValue extracts a single key's value from a tus Upload-Metadata header, which is a
+// comma-separated list of "key base64(value)" pairs.
+func tusMetaValue(meta, key string) string {
+	for _, kv := range strings.Split(meta, ",") {
+		parts := strings.Fields(strings.TrimSpace(kv))
+		if len(parts) == 2 && parts[0] == key {
+			if val, err := base64.StdEncoding.DecodeString(parts[1]); err == nil {
+				return string(val)
+			}
+		}
+	}
+	return ""
+}
+
+// presignPendingExpiration is how long a reserved-but-never-completed presigned upload is
+// kept around before largeFileRunGarbageCollection sweeps it.
+const presignPendingExpiration = 30 * time.Minute
+
+// largeFilePresignUpload handles POST /v0/file/s/presign-up: it reserves a pending FileDef
+// and returns a presigned URL (plus any headers/form fields) the client uses to PUT the bytes
+// straight to the backing object store, bypassing this server's data path entirely.
+func largeFilePresignUpload(wrt http.ResponseWriter, req *http.Request) {
+	now := time.Now().UTC().Round(time.Millisecond)
+	enc := json.NewEncoder(wrt)
+	mh := store.GetMediaHandler()
+
+	writeHttpResponse := func(msg *ServerComMessage, err error) {
+		wrt.Header().Set("Content-Type", "application/json; charset=utf-8")
+		wrt.WriteHeader(msg.Ctrl.Code)
+		enc.Encode(msg)
+
+		log.Println("media presign-up", msg.Ctrl.Code, msg.Ctrl.Text, err)
+	}
+
+	if isValid, _ := checkAPIKey(getAPIKey(req)); !isValid {
+		writeHttpResponse(ErrAPIKeyRequired(now), nil)
+		return
+	}
+
+	uid, challenge, err := authHttpRequest(req)
+	if err != nil {
+		writeHttpResponse(decodeStoreError(err, "", "", now, nil), err)
+		return
+	}
+	if challenge != nil {
+		writeHttpResponse(InfoChallenge("", now, challenge), nil)
+		return
+	}
+	if uid.IsZero() {
+		writeHttpResponse(ErrAuthRequired("", "", now), nil)
+		return
+	}
+
+	// The client declares the size it intends to PUT directly to the backing store; since
+	// those bytes never pass through this server, this declared size is the only chance to
+	// enforce maxFileUploadSize before a presigned upload is handed out.
+	declaredSize, err := strconv.ParseInt(req.URL.Query().Get("size"), 10, 64)
+	if err != nil || declaredSize < 0 {
+		writeHttpResponse(ErrMalformed("", "", now), err)
+		return
+	}
+	if globals.maxFileUploadSize > 0 && declaredSize > globals.maxFileUploadSize {
+		writeHttpResponse(ErrTooLarge("", "", now), nil)
+		return
+	}
+
+	fdef := types.FileDef{}
+	fdef.Id = store.GetUidString()
+	fdef.InitTimes()
+	fdef.User = uid.String()
+	fdef.Status = types.UploadStarted
+	fdef.Size = declaredSize
+	fdef.MimeType = req.URL.Query().Get("mime")
+
+	// PresignUpload can assign fdef.Location (e.g. the backend object key it reserved for
+	// this upload) as a side effect; do that before StartUpload snapshots *fdef by value into
+	// the pending-upload table, or a real backend's assignment would be silently lost and
+	// largeFilePresignComplete would later read back a stale/empty Location.
+	presignedURL, headers, formFields, err := mh.PresignUpload(&fdef)
+	if err != nil {
+		writeHttpResponse(decodeStoreError(err, "", "", now, nil), err)
+		return
+	}
+
+	if err := store.Files.StartUpload(&fdef); err != nil {
+		writeHttpResponse(decodeStoreError(err, "", "", now, nil), err)
+		return
+	}
+
+	resp := NoErr("", "", now)
+	resp.Ctrl.Params = map[string]interface{}{
+		"fid":    fdef.Id,
+		"url":    presignedURL,
+		"header": headers,
+		"form":   formFields,
+	}
+	writeHttpResponse(resp, nil)
+}
+
+// largeFilePresignDownload handles POST /v0/file/s/presign-down: it authenticates the caller,
+// checks ownership of the requested file, and returns a presigned GET URL to fetch the blob
+// straight from the backing object store.
+func largeFilePresignDownload(wrt http.ResponseWriter, req *http.Request) {
+	now := time.Now().UTC().Round(time.Millisecond)
+	enc := json.NewEncoder(wrt)
+	mh := store.GetMediaHandler()
+
+	writeHttpResponse := func(msg *ServerComMessage, err error) {
+		wrt.Header().Set("Content-Type", "application/json; charset=utf-8")
+		wrt.WriteHeader(msg.Ctrl.Code)
+		enc.Encode(msg)
+
+		log.Println("media presign-down", msg.Ctrl.Code, msg.Ctrl.Text, err)
+	}
+
+	if isValid, _ := checkAPIKey(getAPIKey(req)); !isValid {
+		writeHttpResponse(ErrAPIKeyRequired(now), nil)
+		return
+	}
+
+	uid, challenge, err := authHttpRequest(req)
+	if err != nil {
+		writeHttpResponse(decodeStoreError(err, "", "", now, nil), err)
+		return
+	}
+	if challenge != nil {
+		writeHttpResponse(InfoChallenge("", now, challenge), nil)
+		return
+	}
+	if uid.IsZero() {
+		writeHttpResponse(ErrAuthRequired("", "", now), nil)
+		return
+	}
+
+	fid := req.URL.Query().Get("fid")
+	fdef, rsc, err := mh.Download(fid)
+	if err != nil {
+		writeHttpResponse(decodeStoreError(err, "", "", now, nil), err)
+		return
+	}
+	// Only the metadata is needed here; close the content reader right away instead of
+	// leaking the backing file handle/connection until GC.
+	rsc.Close()
+	if !fdef.CanRead(uid.String()) {
+		writeHttpResponse(ErrPermissionDenied("", "", now), nil)
+		return
+	}
+
+	presignedURL, err := mh.PresignDownload(fdef.Location)
+	if err != nil {
+		writeHttpResponse(decodeStoreError(err, "", "", now, nil), err)
+		return
+	}
+
+	resp := NoErr("", "", now)
+	resp.Ctrl.Params = map[string]string{"url": presignedURL}
+	writeHttpResponse(resp, nil)
+}
+
+// largeFilePresignComplete handles POST /v0/file/s/complete: once the client has PUT the
+// bytes directly to the object store, this verifies the object actually exists there,
+// records its true size and digest, and flips the reserved FileDef from pending to committed.
+func largeFilePresignComplete(wrt http.ResponseWriter, req *http.Request) {
+	now := time.Now().UTC().Round(time.Millisecond)
+	enc := json.NewEncoder(wrt)
+	mh := store.GetMediaHandler()
+
+	writeHttpResponse := func(msg *ServerComMessage, err error) {
+		wrt.Header().Set("Content-Type", "application/json; charset=utf-8")
+		wrt.WriteHeader(msg.Ctrl.Code)
+		enc.Encode(msg)
+
+		log.Println("media presign-complete", msg.Ctrl.Code, msg.Ctrl.Text, err)
+	}
+
+	if isValid, _ := checkAPIKey(getAPIKey(req)); !isValid {
+		writeHttpResponse(ErrAPIKeyRequired(now), nil)
+		return
+	}
+
+	uid, challenge, err := authHttpRequest(req)
+	if err != nil {
+		writeHttpResponse(decodeStoreError(err, "", "", now, nil), err)
+		return
+	}
+	if challenge != nil {
+		writeHttpResponse(InfoChallenge("", now, challenge), nil)
+		return
+	}
+	if uid.IsZero() {
+		writeHttpResponse(ErrAuthRequired("", "", now), nil)
+		return
+	}
+
+	fid := req.FormValue("fid")
+	fdef, _, err := store.Files.GetUpload(fid)
+	if err != nil {
+		writeHttpResponse(decodeStoreError(err, "", "", now, nil), err)
+		return
+	}
+	if fdef.User != uid.String() {
+		writeHttpResponse(ErrPermissionDenied("", "", now), nil)
+		return
+	}
+
+	size, digest, err := mh.StatObject(fdef.Location)
+	if err != nil {
+		// The object never showed up in the bucket: leave the row pending so the pending-upload
+		// sweep in largeFileRunGarbageCollection eventually reclaims it.
+		writeHttpResponse(decodeStoreError(err, "", "", now, nil), err)
+		return
+	}
+
+	// Bytes PUT straight to the backing store by the client never passed through
+	// commitUploadContent, so this is the only chance to run them past the MediaScanner:
+	// without this, the presign endpoint would be a silent bypass of the scan feature.
+	verdict := types.ScanNotScanned
+	if scanner := globals.mediaScanner; scanner != nil {
+		_, rsc, derr := mh.Download(fdef.Location)
+		if derr != nil {
+			writeHttpResponse(decodeStoreError(derr, "", "", now, nil), derr)
+			return
+		}
+		sverdict, serr := scanner.Scan(rsc, fdef.MimeType)
+		rsc.Close()
+		if serr != nil {
+			if globals.mediaScanFailClosed {
+				writeHttpResponse(ErrUnknown("", "", now), serr)
+				return
+			}
+			log.Println("media presign-complete: scanner error, failing open:", serr)
+		} else if sverdict == types.ScanInfected {
+			store.Files.CompleteUpload(fid, types.UploadFailed, "", "", 0, sverdict)
+			writeHttpResponse(ErrContentRejected("", "", now), nil)
+			return
+		} else {
+			verdict = sverdict
+		}
+	}
+
+	if err := store.Files.CompleteUpload(fid, types.UploadCompleted, fdef.Location, digest, size, verdict); err != nil {
+		writeHttpResponse(decodeStoreError(err, "", "", now, nil), err)
+		return
+	}
+
+	resp := NoErr("", "", now)
+	resp.Ctrl.Params = map[string]string{"url": fdef.Location, "digest": digest}
+	writeHttpResponse(resp, nil)
+}
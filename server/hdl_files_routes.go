@@ -0,0 +1,34 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *    Route registration for the large-file endpoints implemented in this
+ *    package. Call registerLargeFileHandlers from the server's HTTP setup
+ *    once a mux is available, alongside the rest of the REST API routes.
+ *
+ *****************************************************************************/
+
+package main
+
+import "net/http"
+
+// registerLargeFileHandlers wires the large-file upload/download endpoints onto mux with a
+// single HandleFunc per path and no method-based routing. largeFileUpload (POST only) and
+// largeFileUploadTus (POST/HEAD/PATCH switch) check the request method themselves; the other
+// handlers do not check it.
+func registerLargeFileHandlers(mux *http.ServeMux) {
+	// Plain upload/download, and the caller's own attachments bundled as an archive.
+	mux.HandleFunc("/v0/file/u/", largeFileUpload)
+	mux.HandleFunc("/v0/file/s/archive", largeFileServeArchive)
+	mux.HandleFunc("/v0/file/s/", largeFileServe)
+
+	// tus.io resumable upload: POST creates at the bare path, HEAD/PATCH address a specific
+	// upload id under it.
+	mux.HandleFunc("/v0/file/tus", largeFileUploadTus)
+	mux.HandleFunc("/v0/file/tus/", largeFileUploadTus)
+
+	// Presigned direct-to-backend upload/download.
+	mux.HandleFunc("/v0/file/s/presign-up", largeFilePresignUpload)
+	mux.HandleFunc("/v0/file/s/presign-down", largeFilePresignDownload)
+	mux.HandleFunc("/v0/file/s/complete", largeFilePresignComplete)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+// registerTestUpload commits content through mh into the store.Files registry, mirroring what
+// commitUploadContent does for a real upload, so streamArchiveEntries sees the same ACL/size
+// metadata a production request would.
+func registerTestUpload(t *testing.T, mh store.MediaHandler, uid, content string) *types.FileDef {
+	t.Helper()
+
+	fdef := &types.FileDef{}
+	fdef.Id = store.GetUidString()
+	fdef.InitTimes()
+	fdef.User = uid
+	fdef.MimeType = "text/plain"
+	if err := store.Files.StartUpload(fdef); err != nil {
+		t.Fatalf("StartUpload: %v", err)
+	}
+	if _, err := mh.Upload(fdef, strings.NewReader(content)); err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+	if err := store.Files.CompleteUpload(fdef.Id, types.UploadCompleted, fdef.Location, "digest-"+fdef.Id, int64(len(content)), types.ScanClean); err != nil {
+		t.Fatalf("CompleteUpload: %v", err)
+	}
+	return fdef
+}
+
+// TestStreamArchiveEntries is the regression test for the ACL wiring gap: an owner requesting
+// their own uploaded file must get its real content back, a non-owner must get a
+// "permission denied" entry instead of the file, and a nonexistent fid must get its own error
+// entry without aborting the rest of the archive.
+func TestStreamArchiveEntries(t *testing.T) {
+	mh := store.NewFsMediaHandler(t.TempDir())
+
+	owned := registerTestUpload(t, mh, "usrAlice", "hello world")
+
+	type entry struct {
+		name, mime string
+		size       int64
+		content    string
+	}
+	var got []entry
+	writeEntry := func(name, mime string, size int64, content io.Reader) error {
+		buf, err := io.ReadAll(content)
+		if err != nil {
+			return err
+		}
+		got = append(got, entry{name, mime, size, string(buf)})
+		return nil
+	}
+
+	streamArchiveEntries([]string{owned.Id, "no-such-fid"}, types.Uid("usrAlice"), mh, writeEntry)
+
+	if len(got) != 2 {
+		t.Fatalf("got %d entries, want 2: %+v", len(got), got)
+	}
+	if got[0].content != "hello world" {
+		t.Fatalf("owner did not receive file content: %+v", got[0])
+	}
+	if !strings.Contains(got[1].name, "no-such-fid") {
+		t.Fatalf("missing-fid entry not named after the fid: %+v", got[1])
+	}
+
+	// A non-owner must be denied, not handed the content.
+	got = nil
+	streamArchiveEntries([]string{owned.Id}, types.Uid("usrMallory"), mh, writeEntry)
+	if len(got) != 1 || got[0].content != "permission denied" {
+		t.Fatalf("non-owner was not denied: %+v", got)
+	}
+}
@@ -0,0 +1,169 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *    Pluggable malware-scanning hook invoked by largeFileUpload between mime
+ *    sniffing and mh.Upload.
+ *
+ *****************************************************************************/
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+// MediaScanner inspects an uploaded file's bytes before they are committed to storage.
+// Implementations must read r to completion.
+type MediaScanner interface {
+	Scan(r io.Reader, mime string) (types.ScanVerdict, error)
+}
+
+// noopMediaScanner is the default MediaScanner: it drains the reader and accepts everything.
+type noopMediaScanner struct{}
+
+func (noopMediaScanner) Scan(r io.Reader, mime string) (types.ScanVerdict, error) {
+	_, err := io.Copy(io.Discard, r)
+	return types.ScanClean, err
+}
+
+// clamavScanner drives a clamd INSTREAM scan over a plain TCP connection.
+type clamavScanner struct {
+	addr    string
+	timeout time.Duration
+}
+
+// newClamAVScanner returns a MediaScanner backed by a clamd instance listening at addr
+// (host:port). A zero timeout disables the connection/IO deadline.
+func newClamAVScanner(addr string, timeout time.Duration) *clamavScanner {
+	return &clamavScanner{addr: addr, timeout: timeout}
+}
+
+func (c *clamavScanner) Scan(r io.Reader, mime string) (types.ScanVerdict, error) {
+	conn, err := net.DialTimeout("tcp", c.addr, c.timeout)
+	if err != nil {
+		return types.ScanClean, err
+	}
+	defer conn.Close()
+
+	if c.timeout > 0 {
+		conn.SetDeadline(time.Now().Add(c.timeout))
+	}
+
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return types.ScanClean, err
+	}
+
+	buff := make([]byte, 8192)
+	for {
+		n, rerr := r.Read(buff)
+		if n > 0 {
+			var size [4]byte
+			binary.BigEndian.PutUint32(size[:], uint32(n))
+			if _, err := conn.Write(size[:]); err != nil {
+				return types.ScanClean, err
+			}
+			if _, err := conn.Write(buff[:n]); err != nil {
+				return types.ScanClean, err
+			}
+		}
+		if rerr == io.EOF {
+			break
+		}
+		if rerr != nil {
+			return types.ScanClean, rerr
+		}
+	}
+	// A zero-length chunk terminates the INSTREAM session.
+	if _, err := conn.Write([]byte{0, 0, 0, 0}); err != nil {
+		return types.ScanClean, err
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && err != io.EOF {
+		return types.ScanClean, err
+	}
+
+	if strings.Contains(reply, "FOUND") {
+		return types.ScanInfected, nil
+	}
+	return types.ScanClean, nil
+}
+
+// init wires up the default MediaScanner from the environment so the ClamAV driver added above
+// is actually reachable: set TINODE_CLAMAV_ADDR to a clamd "host:port" to enable it, otherwise
+// uploads are scanned by the no-op driver. TINODE_MEDIA_SCAN_FAIL_CLOSED=1 rejects uploads when
+// the scanner itself errors out instead of the fail_open default.
+//
+// A config-file-driven equivalent belongs in main.go's config parsing once that file is part of
+// this tree; until then this env-var wiring is what makes globals.mediaScanner non-nil.
+func init() {
+	globals.mediaScanner = noopMediaScanner{}
+	if addr := os.Getenv("TINODE_CLAMAV_ADDR"); addr != "" {
+		globals.mediaScanner = newClamAVScanner(addr, 10*time.Second)
+	}
+	globals.mediaScanFailClosed = os.Getenv("TINODE_MEDIA_SCAN_FAIL_CLOSED") == "1"
+}
+
+// ErrContentRejected reports that a file's content was flagged by the MediaScanner, either at
+// upload time or retroactively by rescanStoredFiles.
+func ErrContentRejected(id, topic string, ts time.Time) *ServerComMessage {
+	return &ServerComMessage{
+		Ctrl: &MsgServerCtrl{
+			Id:        id,
+			Topic:     topic,
+			Code:      http.StatusUnprocessableEntity,
+			Text:      "content rejected",
+			Timestamp: ts,
+		},
+	}
+}
+
+// rescanStoredFiles re-runs the configured MediaScanner over every already-committed file and
+// records ScanInfected on any file it now flags; other results leave the stored verdict as it
+// is. A signature update can flag content that was accepted when it was
+// first uploaded, so relying on the upload-time scan alone would let already-stored malware sit
+// around indefinitely; largeFileRunGarbageCollection calls this right before each quarantine
+// sweep so newly-flagged files get caught the same way freshly uploaded ones are.
+func rescanStoredFiles(mh store.MediaHandler) {
+	scanner := globals.mediaScanner
+	if scanner == nil {
+		return
+	}
+
+	for _, fd := range store.Files.AllCommitted() {
+		if fd.ScanVerdict == types.ScanInfected {
+			// Already quarantined; DeleteQuarantined will reclaim it shortly.
+			continue
+		}
+
+		_, rsc, err := mh.Download(fd.Location)
+		if err != nil {
+			log.Println("media rescan: download:", fd.Id, err)
+			continue
+		}
+
+		verdict, err := scanner.Scan(rsc, fd.MimeType)
+		rsc.Close()
+		if err != nil {
+			log.Println("media rescan: scan:", fd.Id, err)
+			continue
+		}
+		if verdict == types.ScanInfected {
+			if err := store.Files.SetScanVerdict(fd.Id, verdict); err != nil {
+				log.Println("media rescan: set verdict:", fd.Id, err)
+			}
+		}
+	}
+}
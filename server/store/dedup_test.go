@@ -0,0 +1,104 @@
+package store
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tinode/chat/server/store/types"
+)
+
+// commitTestFile reserves and commits an upload directly, bypassing the tus append step, for
+// tests that only care about the committed row.
+func commitTestFile(t *testing.T, fs *fileStore, uid, digest string) *types.FileDef {
+	t.Helper()
+
+	fdef := &types.FileDef{}
+	fdef.Id = GetUidString()
+	fdef.InitTimes()
+	fdef.User = uid
+	if err := fs.StartUpload(fdef); err != nil {
+		t.Fatalf("StartUpload: %v", err)
+	}
+	if err := fs.CompleteUpload(fdef.Id, types.UploadCompleted, "/v0/file/s/"+fdef.Id, digest, 5, types.ScanClean); err != nil {
+		t.Fatalf("CompleteUpload: %v", err)
+	}
+	committed, err := fs.FindByDigest(digest)
+	if err != nil || committed == nil {
+		t.Fatalf("FindByDigest: %v, %v", committed, err)
+	}
+	return committed
+}
+
+// TestLinkFileGrantsReadAccess is the regression test for the dedup/ACL conflict: a second
+// uploader whose upload deduplicates onto the first uploader's blob must be able to read it
+// afterwards, not just bump a refcount the original uploader already owned.
+func TestLinkFileGrantsReadAccess(t *testing.T) {
+	fs := newFileStore()
+
+	original := commitTestFile(t, fs, "usrAlice", "digest-shared")
+	if !original.CanRead("usrAlice") || original.CanRead("usrBob") {
+		t.Fatalf("unexpected initial ACL: %+v", original)
+	}
+
+	if err := fs.LinkFile(original.Id, "usrBob"); err != nil {
+		t.Fatalf("LinkFile: %v", err)
+	}
+
+	linked, err := fs.FindByDigest("digest-shared")
+	if err != nil || linked == nil {
+		t.Fatalf("FindByDigest after link: %v, %v", linked, err)
+	}
+	if !linked.CanRead("usrBob") {
+		t.Fatalf("usrBob cannot read the file it deduplicated onto: %+v", linked)
+	}
+	if !linked.CanRead("usrAlice") {
+		t.Fatalf("original uploader lost read access: %+v", linked)
+	}
+	if linked.RefCount != 2 {
+		t.Fatalf("RefCount = %d, want 2", linked.RefCount)
+	}
+
+	// Linking the same uid again must not duplicate the Owners entry.
+	if err := fs.LinkFile(original.Id, "usrBob"); err != nil {
+		t.Fatalf("LinkFile (again): %v", err)
+	}
+	twice, _ := fs.FindByDigest("digest-shared")
+	owners := 0
+	for _, o := range twice.Owners {
+		if o == "usrBob" {
+			owners++
+		}
+	}
+	if owners != 1 {
+		t.Fatalf("usrBob appears %d times in Owners, want 1", owners)
+	}
+}
+
+// TestDeleteUnused checks the refcount floor: a file with refs remaining is never reclaimed
+// regardless of age, and one with a zero refcount is only reclaimed once it's old enough.
+func TestDeleteUnused(t *testing.T) {
+	fs := newFileStore()
+
+	referenced := commitTestFile(t, fs, "usrAlice", "digest-referenced")
+	if err := fs.LinkFile(referenced.Id, "usrBob"); err != nil {
+		t.Fatalf("LinkFile: %v", err)
+	}
+
+	unused := commitTestFile(t, fs, "usrAlice", "digest-unused")
+	fs.mu.Lock()
+	fs.files[referenced.Id].UpdatedAt = time.Now().Add(-48 * time.Hour)
+	fs.files[unused.Id].RefCount = 0
+	fs.files[unused.Id].UpdatedAt = time.Now().Add(-48 * time.Hour)
+	fs.mu.Unlock()
+
+	if err := fs.DeleteUnused(time.Now().Add(-24*time.Hour), 0); err != nil {
+		t.Fatalf("DeleteUnused: %v", err)
+	}
+
+	if found, _ := fs.FindByDigest("digest-referenced"); found == nil {
+		t.Fatal("referenced file was deleted")
+	}
+	if found, _ := fs.FindByDigest("digest-unused"); found != nil {
+		t.Fatal("unused stale file was not deleted")
+	}
+}
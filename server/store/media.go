@@ -0,0 +1,56 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *    MediaHandler is the pluggable backend used by server/hdl_files.go to
+ *    actually store and serve large file attachments (local disk, S3, GCS, ...).
+ *
+ *****************************************************************************/
+
+package store
+
+import (
+	"io"
+
+	"github.com/tinode/chat/server/store/types"
+)
+
+// MediaHandler is implemented by each storage backend the large-file endpoints can delegate
+// object storage to.
+type MediaHandler interface {
+	// Redirect returns a URL to redirect the request to if this handler wants it served
+	// elsewhere (e.g. a CDN), or "" to handle the request itself.
+	Redirect(url string) string
+	// Upload reads file to completion, stores it, fills in fdef.Location and returns the
+	// public download URL.
+	Upload(fdef *types.FileDef, file io.Reader) (string, error)
+	// Download resolves url to the file's metadata and an open, seekable reader over its
+	// content.
+	Download(url string) (*types.FileDef, types.ReadSeekCloser, error)
+	// PresignUpload reserves storage for fdef and returns a presigned URL (plus any headers
+	// or form fields the client must send along) the client can PUT/POST bytes to directly.
+	PresignUpload(fdef *types.FileDef) (presignedURL string, headers map[string]string, formFields map[string]string, err error)
+	// PresignDownload returns a presigned URL the client can GET the object's bytes from
+	// directly, bypassing this server.
+	PresignDownload(location string) (string, error)
+	// StatObject checks that location exists in the backing store and returns its actual size
+	// and content digest (sha256, hex-encoded).
+	StatObject(location string) (size int64, digest string, err error)
+}
+
+var mediaHandler MediaHandler
+
+// RegisterMediaHandler installs h as the media handler used by the large-file endpoints.
+// The last call wins; servers normally call this once at startup based on config.
+func RegisterMediaHandler(h MediaHandler) {
+	mediaHandler = h
+}
+
+// GetMediaHandler returns the currently registered MediaHandler, or the default local-disk
+// handler if none has been registered.
+func GetMediaHandler() MediaHandler {
+	if mediaHandler == nil {
+		mediaHandler = NewFsMediaHandler("")
+	}
+	return mediaHandler
+}
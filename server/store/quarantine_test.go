@@ -0,0 +1,45 @@
+package store
+
+import (
+	"testing"
+
+	"github.com/tinode/chat/server/store/types"
+)
+
+// TestSetScanVerdictAndQuarantine checks the retroactive-rescan path: a file accepted as clean
+// at upload time can later be flagged infected, and DeleteQuarantined reclaims only that one.
+func TestSetScanVerdictAndQuarantine(t *testing.T) {
+	fs := newFileStore()
+
+	commitTestFile(t, fs, "usrAlice", "digest-clean")
+	reflagged := commitTestFile(t, fs, "usrAlice", "digest-reflagged")
+
+	if err := fs.SetScanVerdict(reflagged.Id, types.ScanInfected); err != nil {
+		t.Fatalf("SetScanVerdict: %v", err)
+	}
+
+	all := fs.AllCommitted()
+	var sawReflagged bool
+	for _, fd := range all {
+		if fd.Id == reflagged.Id {
+			sawReflagged = true
+			if fd.ScanVerdict != types.ScanInfected {
+				t.Fatalf("AllCommitted snapshot has stale verdict: %+v", fd)
+			}
+		}
+	}
+	if !sawReflagged {
+		t.Fatal("AllCommitted did not return the reflagged file")
+	}
+
+	if err := fs.DeleteQuarantined(0); err != nil {
+		t.Fatalf("DeleteQuarantined: %v", err)
+	}
+
+	if found, _ := fs.FindByDigest("digest-reflagged"); found != nil {
+		t.Fatal("infected file was not quarantined")
+	}
+	if found, _ := fs.FindByDigest("digest-clean"); found == nil {
+		t.Fatal("clean file was incorrectly quarantined")
+	}
+}
@@ -0,0 +1,294 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *    In-memory (disk-spooled) metadata store for large file attachments:
+ *    committed FileDef rows plus the in-flight state for resumable (tus) and
+ *    presigned uploads. Backs the server/hdl_files.go handlers.
+ *
+ *****************************************************************************/
+
+package store
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/tinode/chat/server/store/types"
+)
+
+// uploadsDir is where the bytes of in-flight resumable/presigned uploads are spooled to disk.
+// The pending-upload table (FileDef and offset) is kept in memory only and is not reloaded
+// from this directory on restart.
+var uploadsDir = filepath.Join(os.TempDir(), "tinode-uploads")
+
+// pendingUpload tracks an upload that has been reserved but not yet committed.
+type pendingUpload struct {
+	fdef   types.FileDef
+	offset int64
+}
+
+// fileStore is the backing implementation for the package-level Files handle.
+type fileStore struct {
+	mu       sync.Mutex
+	files    map[string]*types.FileDef // committed rows, by id
+	byDigest map[string]string         // digest -> file id, for dedup lookups
+	uploads  map[string]*pendingUpload // in-flight uploads, by id
+}
+
+// Files is the package-wide handle to file metadata storage.
+var Files = newFileStore()
+
+func newFileStore() *fileStore {
+	os.MkdirAll(uploadsDir, 0700)
+	return &fileStore{
+		files:    make(map[string]*types.FileDef),
+		byDigest: make(map[string]string),
+		uploads:  make(map[string]*pendingUpload),
+	}
+}
+
+// GetUidString returns a new random id suitable for a FileDef or in-flight upload id.
+func GetUidString() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+func (fs *fileStore) uploadPath(fid string) string {
+	return filepath.Join(uploadsDir, fid+".bin")
+}
+
+// DeleteUnused deletes committed FileDef rows with a zero refcount that haven't been touched
+// since olderThan, up to limit rows (0 means no limit).
+func (fs *fileStore) DeleteUnused(olderThan time.Time, limit int) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	deleted := 0
+	for id, fd := range fs.files {
+		if limit > 0 && deleted >= limit {
+			break
+		}
+		if fd.RefCount <= 0 && fd.UpdatedAt.Before(olderThan) {
+			delete(fs.files, id)
+			delete(fs.byDigest, fd.ETag)
+			os.Remove(fs.uploadPath(id))
+			deleted++
+		}
+	}
+	return nil
+}
+
+// DeleteQuarantined deletes committed rows whose most recent ScanVerdict is ScanInfected, and
+// their spooled upload bytes, up to limit rows (0 means no limit). The blob a MediaHandler
+// stored at the row's Location is not removed.
+func (fs *fileStore) DeleteQuarantined(limit int) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	deleted := 0
+	for id, fd := range fs.files {
+		if limit > 0 && deleted >= limit {
+			break
+		}
+		if fd.ScanVerdict == types.ScanInfected {
+			delete(fs.files, id)
+			delete(fs.byDigest, fd.ETag)
+			os.Remove(fs.uploadPath(id))
+			deleted++
+		}
+	}
+	return nil
+}
+
+// Get returns a copy of the committed FileDef with this id, the metadata (owner, ACL list,
+// ETag, scan verdict) a MediaHandler's Download needs to back a downloaded blob with, not just
+// what it can recover from the backing store itself (e.g. file size from a stat call).
+func (fs *fileStore) Get(id string) (*types.FileDef, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fd, ok := fs.files[id]
+	if !ok {
+		return nil, types.ErrNotFound
+	}
+	cp := *fd
+	return &cp, nil
+}
+
+// FindByDigest returns a copy of the committed FileDef already storing digest, or nil if none.
+func (fs *fileStore) FindByDigest(digest string) (*types.FileDef, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	id, ok := fs.byDigest[digest]
+	if !ok {
+		return nil, nil
+	}
+	fd := *fs.files[id]
+	return &fd, nil
+}
+
+// LinkFile bumps the refcount of the committed file id and records uid as an additional owner
+// entitled to read it, so a deduplicated upload grants its uploader access to the shared blob.
+func (fs *fileStore) LinkFile(id, uid string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fd, ok := fs.files[id]
+	if !ok {
+		return types.ErrNotFound
+	}
+	fd.RefCount++
+	if !fd.CanRead(uid) {
+		fd.Owners = append(fd.Owners, uid)
+	}
+	return nil
+}
+
+// SetScanVerdict records the most recent MediaScanner result for a committed file, e.g. when
+// a signature update flags a file that was already accepted and stored.
+func (fs *fileStore) SetScanVerdict(id string, verdict types.ScanVerdict) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fd, ok := fs.files[id]
+	if !ok {
+		return types.ErrNotFound
+	}
+	fd.ScanVerdict = verdict
+	return nil
+}
+
+// AllCommitted returns a snapshot of every committed FileDef, for periodic re-scanning.
+func (fs *fileStore) AllCommitted() []*types.FileDef {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	out := make([]*types.FileDef, 0, len(fs.files))
+	for _, fd := range fs.files {
+		cp := *fd
+		out = append(out, &cp)
+	}
+	return out
+}
+
+// StartUpload reserves fdef as a pending (not yet committed) upload and creates its empty spool
+// file on disk. The reservation and its offset live only in memory, so a server restart loses
+// them even though the spooled bytes remain on disk.
+func (fs *fileStore) StartUpload(fdef *types.FileDef) error {
+	f, err := os.Create(fs.uploadPath(fdef.Id))
+	if err != nil {
+		return err
+	}
+	f.Close()
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.uploads[fdef.Id] = &pendingUpload{fdef: *fdef}
+	return nil
+}
+
+// GetUpload returns a copy of the FileDef and the current byte offset of a pending upload.
+func (fs *fileStore) GetUpload(fid string) (*types.FileDef, int64, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	up, ok := fs.uploads[fid]
+	if !ok {
+		return nil, 0, types.ErrNotFound
+	}
+	fd := up.fdef
+	return &fd, up.offset, nil
+}
+
+// AppendUpload appends up to maxLen bytes read from r to the spooled blob for fid and returns
+// the new total offset.
+func (fs *fileStore) AppendUpload(fid string, r io.Reader, maxLen int64) (int64, error) {
+	fs.mu.Lock()
+	_, ok := fs.uploads[fid]
+	fs.mu.Unlock()
+	if !ok {
+		return 0, types.ErrNotFound
+	}
+
+	f, err := os.OpenFile(fs.uploadPath(fid), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	n, err := io.Copy(f, io.LimitReader(r, maxLen))
+	if err != nil {
+		return 0, err
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	up, ok := fs.uploads[fid]
+	if !ok {
+		return 0, types.ErrNotFound
+	}
+	up.offset += n
+	return up.offset, nil
+}
+
+// ReadUpload opens the spooled blob for a pending upload for reading, e.g. once it's fully
+// received and ready to be hashed, scanned and handed to a MediaHandler. The caller must Close
+// it when done.
+func (fs *fileStore) ReadUpload(fid string) (*os.File, error) {
+	return os.Open(fs.uploadPath(fid))
+}
+
+// CompleteUpload moves a pending upload out of the in-flight table. On UploadCompleted, the
+// committed row records location/digest/size/verdict and is indexed by digest for future dedup
+// lookups; any other status (e.g. UploadFailed) just discards the spooled bytes.
+func (fs *fileStore) CompleteUpload(fid string, status int, location, digest string, size int64, verdict types.ScanVerdict) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	up, ok := fs.uploads[fid]
+	if !ok {
+		return types.ErrNotFound
+	}
+	delete(fs.uploads, fid)
+
+	if status != types.UploadCompleted {
+		os.Remove(fs.uploadPath(fid))
+		return nil
+	}
+
+	fd := up.fdef
+	fd.Status = status
+	fd.Location = location
+	fd.ETag = digest
+	fd.Size = size
+	fd.ScanVerdict = verdict
+	fd.RefCount = 1
+	fs.files[fd.Id] = &fd
+	if fd.ETag != "" {
+		fs.byDigest[fd.ETag] = fd.Id
+	}
+	return nil
+}
+
+// DeleteStaleUploads removes pending uploads reserved before olderThan that were never
+// completed, reclaiming their spooled bytes.
+func (fs *fileStore) DeleteStaleUploads(olderThan time.Time) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	for fid, up := range fs.uploads {
+		if up.fdef.CreatedAt.Before(olderThan) {
+			delete(fs.uploads, fid)
+			os.Remove(fs.uploadPath(fid))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+/******************************************************************************
+ *
+ *  Description :
+ *
+ *    Shared data types for the store package: object ids, headers and the
+ *    large-file metadata record used by the server/hdl_files.go handlers.
+ *
+ *****************************************************************************/
+
+package types
+
+import (
+	"errors"
+	"io"
+	"time"
+)
+
+// Uid is an opaque user id, same shape as the rest of the store layer uses for user ids.
+type Uid string
+
+// String returns the string form of the uid.
+func (u Uid) String() string {
+	return string(u)
+}
+
+// IsZero reports whether the uid is unset.
+func (u Uid) IsZero() bool {
+	return u == ""
+}
+
+// ObjHeader is the common set of fields every stored object carries.
+type ObjHeader struct {
+	Id        string
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// InitTimes sets CreatedAt/UpdatedAt to the current time.
+func (h *ObjHeader) InitTimes() {
+	now := time.Now().UTC().Round(time.Millisecond)
+	h.CreatedAt = now
+	h.UpdatedAt = now
+}
+
+// Upload status values for FileDef.Status.
+const (
+	// UploadStarted means the upload was reserved but bytes are not fully received yet.
+	UploadStarted = iota
+	// UploadCompleted means the blob was fully received and committed to storage.
+	UploadCompleted
+	// UploadFailed means the upload was reserved but never completed successfully.
+	UploadFailed
+)
+
+// ScanVerdict is the result of running a MediaScanner over a file's bytes.
+type ScanVerdict int
+
+const (
+	// ScanNotScanned is the zero value: no scanner has looked at this file yet.
+	ScanNotScanned ScanVerdict = iota
+	// ScanClean means the scanner found nothing objectionable.
+	ScanClean
+	// ScanInfected means the scanner flagged the content as malware.
+	ScanInfected
+)
+
+// FileDef is the metadata record for a large file attachment: who owns it, where the bytes
+// live, and what the server knows about its content.
+type FileDef struct {
+	ObjHeader
+	// User is the uid of the file's original uploader.
+	User string
+	// Owners holds additional uids entitled to read this file, e.g. other uploaders whose
+	// upload deduplicated onto this same blob.
+	Owners []string
+	// Status is one of UploadStarted/UploadCompleted/UploadFailed.
+	Status int
+	MimeType string
+	Size     int64
+	// Location is the backend-specific path or key the blob is stored under.
+	Location string
+	// ETag is the SHA-256 digest of the content, hex-encoded.
+	ETag string
+	// RefCount counts how many uploads point at this blob; DeleteUnused only reclaims blobs
+	// once it drops to zero.
+	RefCount int
+	// ScanVerdict is the most recent MediaScanner result for this file's content.
+	ScanVerdict ScanVerdict
+}
+
+// CanRead reports whether uid is entitled to read this file: either the original uploader or
+// one of the uids a later deduplicated upload linked onto it.
+func (fd *FileDef) CanRead(uid string) bool {
+	if fd.User == uid {
+		return true
+	}
+	for _, owner := range fd.Owners {
+		if owner == uid {
+			return true
+		}
+	}
+	return false
+}
+
+// ReadSeekCloser is what MediaHandler.Download returns: a seekable reader so http.ServeContent
+// can serve Range requests, closed by the caller when done.
+type ReadSeekCloser interface {
+	io.Reader
+	io.Seeker
+	io.Closer
+}
+
+// Errors returned by the store layer.
+var (
+	ErrNotFound = errors.New("store: not found")
+	// ErrConflict is returned when a request's expectation of existing state (e.g. a tus
+	// Upload-Offset) doesn't match what the store has on record.
+	ErrConflict = errors.New("store: conflict")
+	// ErrNotImplemented is returned by MediaHandler backends that don't support an optional
+	// capability, e.g. presigned URLs on the local-disk handler.
+	ErrNotImplemented = errors.New("store: not implemented")
+)